@@ -0,0 +1,321 @@
+package instance
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	qrcode "github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TwoFactorTOTP authenticates logins with a time-based one-time password
+// (RFC 6238) generated from a secret shared with the user's authenticator
+// app. Unlike TwoFactorMail it does not depend on email delivery and works
+// offline.
+const TwoFactorTOTP AuthMode = 2
+
+const (
+	totpSecretSize = 20
+	totpDigits     = 6
+	totpPeriod     = 30 * time.Second
+	// totpSkew is the number of periods of tolerance allowed on either side
+	// of the current time, to absorb clock drift between server and device.
+	totpSkew = 1
+
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// totpSettingsSecret and totpSettingsRecoveryCodes are the keys under which
+// the TOTP secret and hashed recovery codes are stored in the instance's
+// settings document. The secret itself is stored AES-256-GCM encrypted (see
+// encryptTOTPSecret), not in the clear, so that a leak of the settings
+// database alone is not enough to forge a user's TOTP codes.
+const (
+	totpSettingsSecret        = "two_factor_totp_secret"
+	totpSettingsRecoveryCodes = "two_factor_totp_recovery_codes"
+)
+
+// totpEncryptionKeyEnv is the environment variable holding the base64
+// encoded AES-256 key used to encrypt TOTP secrets at rest. It is
+// deliberately kept out of the settings document and out of the regular
+// config file, so that neither a database dump nor a config leak alone
+// lets an attacker decrypt a stored secret.
+const totpEncryptionKeyEnv = "COZY_TOTP_SECRET_KEY"
+
+func totpEncryptionKey() ([]byte, error) {
+	encoded := os.Getenv(totpEncryptionKeyEnv)
+	if encoded == "" {
+		return nil, errors.New("instance: " + totpEncryptionKeyEnv + " is not set")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("instance: invalid %s: %s", totpEncryptionKeyEnv, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("instance: %s must decode to a 32 byte AES-256 key", totpEncryptionKeyEnv)
+	}
+	return key, nil
+}
+
+// encryptTOTPSecret encrypts secret with AES-256-GCM for storage in the
+// settings document, using a random nonce prepended to the returned
+// ciphertext.
+func encryptTOTPSecret(secret string) (string, error) {
+	key, err := totpEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ciphertext := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decryptTOTPSecret reverses encryptTOTPSecret.
+func decryptTOTPSecret(encoded string) (string, error) {
+	key, err := totpEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("instance: malformed encrypted TOTP secret")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// StartTOTPActivation generates a new TOTP secret for the instance, stores
+// it (pending confirmation) in the settings document, and returns the
+// otpauth:// provisioning URI along with a PNG QR code of it for the
+// client to display.
+func (i *Instance) StartTOTPActivation() (uri string, qrPNG []byte, err error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", nil, err
+	}
+
+	encrypted, err := encryptTOTPSecret(secret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	doc, err := i.SettingsDocument()
+	if err != nil {
+		return "", nil, err
+	}
+	doc.M[totpSettingsSecret] = encrypted
+	if err := couchdbUpdateSettings(i, doc); err != nil {
+		return "", nil, err
+	}
+
+	uri = totpProvisioningURI(secret, "cozy", i.Domain)
+	qrPNG, err = qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return "", nil, err
+	}
+	return uri, qrPNG, nil
+}
+
+// ValidateTOTPActivationCode confirms a pending TOTP activation: if code
+// matches the secret stored by StartTOTPActivation, it also generates a
+// fresh batch of recovery codes, persists their bcrypt hashes, and returns
+// the plaintext codes so they can be shown to the user once.
+func (i *Instance) ValidateTOTPActivationCode(code string) (recoveryCodes []string, ok bool, err error) {
+	doc, err := i.SettingsDocument()
+	if err != nil {
+		return nil, false, err
+	}
+
+	encrypted, _ := doc.M[totpSettingsSecret].(string)
+	secret, err := decryptTOTPSecret(encrypted)
+	if err != nil || !validateTOTP(secret, code) {
+		return nil, false, nil
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, false, err
+	}
+	doc.M[totpSettingsRecoveryCodes] = hashes
+	if err := couchdbUpdateSettings(i, doc); err != nil {
+		return nil, false, err
+	}
+
+	return codes, true, nil
+}
+
+// ValidateTOTPCode reports whether code is a valid TOTP for the instance's
+// stored secret, or a still-unused recovery code. In the latter case the
+// matched code is removed so it cannot be replayed.
+func (i *Instance) ValidateTOTPCode(code string) (bool, error) {
+	doc, err := i.SettingsDocument()
+	if err != nil {
+		return false, err
+	}
+
+	if encrypted, _ := doc.M[totpSettingsSecret].(string); encrypted != "" {
+		if secret, err := decryptTOTPSecret(encrypted); err == nil && validateTOTP(secret, code) {
+			return true, nil
+		}
+	}
+
+	// The hashes are a []string when set in this process, but a
+	// []interface{} once the settings document has been read back.
+	var hashes []string
+	switch v := doc.M[totpSettingsRecoveryCodes].(type) {
+	case []string:
+		hashes = v
+	case []interface{}:
+		for _, h := range v {
+			if s, ok := h.(string); ok {
+				hashes = append(hashes, s)
+			}
+		}
+	}
+	remaining, ok := consumeRecoveryCode(hashes, code)
+	if !ok {
+		return false, nil
+	}
+	doc.M[totpSettingsRecoveryCodes] = remaining
+	if err := couchdbUpdateSettings(i, doc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func couchdbUpdateSettings(i *Instance, doc *couchdb.JSONDoc) error {
+	return couchdb.UpdateDoc(i, doc)
+}
+
+func generateTOTPSecret() (string, error) {
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(raw), nil
+}
+
+func totpProvisioningURI(secret, issuer, label string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", int(totpPeriod.Seconds())))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s",
+		url.PathEscape(issuer), url.PathEscape(label), v.Encode())
+}
+
+// generateHOTP computes the HOTP value (RFC 4226) for the given base32
+// secret and counter.
+func generateHOTP(secret string, counter uint64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).
+		DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := (uint32(sum[offset])&0x7f)<<24 |
+		uint32(sum[offset+1])<<16 |
+		uint32(sum[offset+2])<<8 |
+		uint32(sum[offset+3])
+
+	mod := uint32(math.Pow10(totpDigits))
+	return fmt.Sprintf("%0*d", totpDigits, code%mod), nil
+}
+
+func validateTOTP(secret, code string) bool {
+	now := time.Now()
+	step := int64(totpPeriod.Seconds())
+	for i := -totpSkew; i <= totpSkew; i++ {
+		counter := uint64(now.Add(time.Duration(i)*totpPeriod).Unix() / step)
+		expected, err := generateHOTP(secret, counter)
+		if err == nil && expected == code {
+			return true
+		}
+	}
+	return false
+}
+
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for n := 0; n < recoveryCodeCount; n++ {
+		raw := make([]byte, recoveryCodeLength)
+		if _, err = rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)[:recoveryCodeLength]
+
+		var hash []byte
+		hash, err = bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		codes = append(codes, code)
+		hashes = append(hashes, string(hash))
+	}
+	return codes, hashes, nil
+}
+
+// consumeRecoveryCode reports whether code matches one of hashes. If so, it
+// returns the remaining hashes with the matched one removed so the same
+// recovery code cannot be used twice.
+func consumeRecoveryCode(hashes []string, code string) (remaining []string, ok bool) {
+	for idx, h := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(h), []byte(code)) == nil {
+			remaining = append(remaining, hashes[:idx]...)
+			remaining = append(remaining, hashes[idx+1:]...)
+			return remaining, true
+		}
+	}
+	return hashes, false
+}
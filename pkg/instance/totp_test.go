@@ -0,0 +1,98 @@
+package instance
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setTestTOTPKey(t *testing.T) {
+	t.Helper()
+	old, had := os.LookupEnv(totpEncryptionKeyEnv)
+	assert.NoError(t, os.Setenv(totpEncryptionKeyEnv, "VDR0YyeFTyfUVto10to197T8v+1xvxCDJ13kBvdsIPU="))
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(totpEncryptionKeyEnv, old)
+		} else {
+			os.Unsetenv(totpEncryptionKeyEnv)
+		}
+	})
+}
+
+func codeAt(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	counter := uint64(at.Unix() / int64(totpPeriod.Seconds()))
+	code, err := generateHOTP(secret, counter)
+	assert.NoError(t, err)
+	return code
+}
+
+func TestValidateTOTPWithinClockSkew(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	assert.NoError(t, err)
+
+	now := time.Now()
+	assert.True(t, validateTOTP(secret, codeAt(t, secret, now)))
+	assert.True(t, validateTOTP(secret, codeAt(t, secret, now.Add(-totpPeriod))))
+	assert.True(t, validateTOTP(secret, codeAt(t, secret, now.Add(totpPeriod))))
+}
+
+func TestValidateTOTPOutsideClockSkewFails(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	assert.NoError(t, err)
+
+	now := time.Now()
+	assert.False(t, validateTOTP(secret, codeAt(t, secret, now.Add(2*totpPeriod))))
+	assert.False(t, validateTOTP(secret, codeAt(t, secret, now.Add(-2*totpPeriod))))
+}
+
+func TestEncryptTOTPSecretRoundTrip(t *testing.T) {
+	setTestTOTPKey(t)
+
+	secret, err := generateTOTPSecret()
+	assert.NoError(t, err)
+
+	encrypted, err := encryptTOTPSecret(secret)
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret, encrypted, "the stored secret must not be the plaintext one")
+
+	decrypted, err := decryptTOTPSecret(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, secret, decrypted)
+}
+
+func TestConsumeRecoveryCodeReplayFails(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, codes)
+
+	remaining, ok := consumeRecoveryCode(hashes, codes[0])
+	assert.True(t, ok)
+	assert.Len(t, remaining, len(hashes)-1)
+
+	// Replaying the same code against the updated (already consumed) list
+	// of hashes must fail.
+	_, ok = consumeRecoveryCode(remaining, codes[0])
+	assert.False(t, ok)
+}
+
+func TestConsumeRecoveryCodeExhaustion(t *testing.T) {
+	codes, hashes, err := generateRecoveryCodes()
+	assert.NoError(t, err)
+	assert.Len(t, codes, recoveryCodeCount)
+
+	for _, code := range codes {
+		var ok bool
+		hashes, ok = consumeRecoveryCode(hashes, code)
+		assert.True(t, ok)
+	}
+	assert.Empty(t, hashes, "all recovery codes should have been consumed")
+
+	// None of the original codes should validate anymore.
+	for _, code := range codes {
+		_, ok := consumeRecoveryCode(hashes, code)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,72 @@
+package instance
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// twoFactorTokenTTL bounds how long a successful passphrase step can be
+// exchanged for a second-factor check. It only needs to survive the round
+// trip to the two-factor form and back, so it is kept short.
+const twoFactorTokenTTL = 5 * time.Minute
+
+// GenerateTwoFactorToken is called once the passphrase step of login
+// succeeds for an instance that requires a second factor. It returns an
+// opaque, signed token binding that success to this domain and a short
+// expiry, which the client must echo back alongside the two-factor code.
+// Without such a token, the two-factor endpoint would have no way to tell
+// that a passphrase was ever checked, turning the second factor into a
+// bypass of the first rather than an addition to it.
+func (i *Instance) GenerateTwoFactorToken() (string, error) {
+	key, err := totpEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(twoFactorTokenTTL).Unix()
+	return signTwoFactorToken(key, i.Domain, expires), nil
+}
+
+// CheckTwoFactorToken reports whether token was issued by
+// GenerateTwoFactorToken for this instance and has not expired.
+func (i *Instance) CheckTwoFactorToken(token string) bool {
+	key, err := totpEncryptionKey()
+	if err != nil {
+		return false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 {
+		return false
+	}
+	domain, expiresStr, sig := parts[0], parts[1], parts[2]
+	if domain != i.Domain {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(signaturePart(key, domain, expiresStr)))
+}
+
+func signTwoFactorToken(key []byte, domain string, expires int64) string {
+	expiresStr := strconv.FormatInt(expires, 10)
+	payload := fmt.Sprintf("%s|%s|%s", domain, expiresStr, signaturePart(key, domain, expiresStr))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload))
+}
+
+func signaturePart(key []byte, domain, expiresStr string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(domain + "|" + expiresStr))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
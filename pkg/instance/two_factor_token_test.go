@@ -0,0 +1,55 @@
+package instance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTwoFactorTokenRoundTrip(t *testing.T) {
+	setTestTOTPKey(t)
+
+	inst := &Instance{Domain: "cozy.example.com"}
+	token, err := inst.GenerateTwoFactorToken()
+	assert.NoError(t, err)
+	assert.True(t, inst.CheckTwoFactorToken(token))
+}
+
+func TestTwoFactorTokenWrongDomainFails(t *testing.T) {
+	setTestTOTPKey(t)
+
+	issuer := &Instance{Domain: "cozy.example.com"}
+	token, err := issuer.GenerateTwoFactorToken()
+	assert.NoError(t, err)
+
+	other := &Instance{Domain: "other.example.com"}
+	assert.False(t, other.CheckTwoFactorToken(token), "a token issued for one domain must not validate another")
+}
+
+func TestTwoFactorTokenExpired(t *testing.T) {
+	setTestTOTPKey(t)
+
+	key, err := totpEncryptionKey()
+	assert.NoError(t, err)
+
+	inst := &Instance{Domain: "cozy.example.com"}
+	expired := signTwoFactorToken(key, inst.Domain, 0)
+	assert.False(t, inst.CheckTwoFactorToken(expired))
+}
+
+func TestTwoFactorTokenTamperedSignatureFails(t *testing.T) {
+	setTestTOTPKey(t)
+
+	inst := &Instance{Domain: "cozy.example.com"}
+	token, err := inst.GenerateTwoFactorToken()
+	assert.NoError(t, err)
+
+	assert.False(t, inst.CheckTwoFactorToken(token+"x"), "a tampered token must not validate")
+}
+
+func TestTwoFactorTokenEmptyFails(t *testing.T) {
+	setTestTOTPKey(t)
+
+	inst := &Instance{Domain: "cozy.example.com"}
+	assert.False(t, inst.CheckTwoFactorToken(""), "an empty token must never validate")
+}
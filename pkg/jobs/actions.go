@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	redisActionPrefix  = "j/action/"
+	redisRunningPrefix = "j/running/"
+)
+
+// ActionHandler is invoked when a permitted caller triggers a named action
+// on a worker type, either against an already-Running job of that type or,
+// failing that, against a short-lived Manual job spawned on the fly.
+type ActionHandler func(domain string, payload json.RawMessage) error
+
+type actionRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]map[string]ActionHandler
+}
+
+func newActionRegistry() *actionRegistry {
+	return &actionRegistry{handlers: make(map[string]map[string]ActionHandler)}
+}
+
+// RegisterAction declares a named action for the given worker type. It is
+// typically called once at startup, from the app manifest loader, for
+// every action a konnector declares.
+func (b *redisBroker) RegisterAction(workerType, name string, handler ActionHandler) {
+	b.actions.mu.Lock()
+	defer b.actions.mu.Unlock()
+	if b.actions.handlers[workerType] == nil {
+		b.actions.handlers[workerType] = make(map[string]ActionHandler)
+	}
+	b.actions.handlers[workerType][name] = handler
+}
+
+// actionDeclaring is implemented by a WorkerConfig that exposes the named
+// actions a manifest declared for it. StartWorkers registers them all, so
+// a manifest author only has to populate WorkerConfig.Actions and never
+// has to call RegisterAction directly.
+type actionDeclaring interface {
+	WorkerActions() map[string]ActionHandler
+}
+
+// registerConfiguredActions registers every action conf declares, if any.
+func (b *redisBroker) registerConfiguredActions(conf *WorkerConfig) {
+	ad, ok := interface{}(conf).(actionDeclaring)
+	if !ok {
+		return
+	}
+	for name, handler := range ad.WorkerActions() {
+		b.RegisterAction(conf.WorkerType, name, handler)
+	}
+}
+
+func (b *redisBroker) lookupAction(workerType, name string) (ActionHandler, bool) {
+	b.actions.mu.RLock()
+	defer b.actions.mu.RUnlock()
+	h, ok := b.actions.handlers[workerType][name]
+	return h, ok
+}
+
+// RunAction triggers the named action for the given domain and worker
+// type: it runs the registered ActionHandler synchronously, then, if a job
+// of that worker type is currently Running for this domain, also pushes
+// the payload onto its action channel so the worker can react to it
+// between execution steps. Otherwise a short-lived Manual job targeting
+// the action is spawned.
+func (b *redisBroker) RunAction(domain, workerType, action string, payload json.RawMessage) error {
+	if !utils.IsInArray(workerType, b.workersTypes) {
+		return ErrUnknownWorker
+	}
+	handler, ok := b.lookupAction(workerType, action)
+	if !ok {
+		return ErrUnknownWorker
+	}
+	if err := handler(domain, payload); err != nil {
+		return err
+	}
+
+	if jobID, err := b.runningJobID(domain, workerType); err == nil && jobID != "" {
+		return b.client.LPush(redisActionPrefix+jobID, string(payload)).Err()
+	}
+
+	msg := struct {
+		Action  string          `json:"action"`
+		Payload json.RawMessage `json:"payload"`
+	}{Action: action, Payload: payload}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.PushJob(&JobRequest{
+		Domain:     domain,
+		WorkerType: workerType,
+		Message:    data,
+		Manual:     true,
+	})
+	return err
+}
+
+// trackRunning records jobID as the currently Running job for domain and
+// workerType, so that RunAction can find it.
+func (b *redisBroker) trackRunning(domain, workerType, jobID string) error {
+	return b.client.HSet(redisRunningPrefix+domain, workerType, jobID).Err()
+}
+
+// untrackRunning clears the Running job recorded for domain and
+// workerType, once it reaches a terminal state.
+func (b *redisBroker) untrackRunning(domain, workerType string) error {
+	return b.client.HDel(redisRunningPrefix+domain, workerType).Err()
+}
+
+func (b *redisBroker) runningJobID(domain, workerType string) (string, error) {
+	return b.client.HGet(redisRunningPrefix+domain, workerType).Result()
+}
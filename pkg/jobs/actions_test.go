@@ -0,0 +1,125 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunActionAgainstRunningJobPushesToItsChannel(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b := &redisBroker{
+		client:       client,
+		closed:       make(chan struct{}),
+		stats:        NewJobStatsManager(client),
+		actions:      newActionRegistry(),
+		workersTypes: []string{"sendmail"},
+	}
+	var handlerCalls int
+	var handlerPayload json.RawMessage
+	b.RegisterAction("sendmail", "refresh", func(domain string, payload json.RawMessage) error {
+		handlerCalls++
+		handlerPayload = payload
+		return nil
+	})
+
+	domain, jobID := "cozy.example.com", "job1"
+	assert.NoError(t, b.trackRunning(domain, "sendmail", jobID))
+
+	payload := json.RawMessage(`{"foo":"bar"}`)
+	assert.NoError(t, b.RunAction(domain, "sendmail", "refresh", payload))
+
+	assert.Equal(t, 1, handlerCalls, "the registered handler must actually run")
+	assert.Equal(t, payload, handlerPayload)
+
+	got, err := client.LRange(redisActionPrefix+jobID, 0, -1).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{string(payload)}, got)
+}
+
+func TestRunActionHandlerErrorAbortsBeforeQueueing(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b := &redisBroker{
+		client:       client,
+		closed:       make(chan struct{}),
+		stats:        NewJobStatsManager(client),
+		actions:      newActionRegistry(),
+		workersTypes: []string{"sendmail"},
+		running:      1,
+	}
+	handlerErr := errors.New("refresh failed")
+	b.RegisterAction("sendmail", "refresh", func(domain string, payload json.RawMessage) error {
+		return handlerErr
+	})
+
+	err = b.RunAction("cozy.example.com", "sendmail", "refresh", json.RawMessage(`{}`))
+	assert.Equal(t, handlerErr, err)
+
+	n, err := client.LLen(redisPrefix + "sendmail" + redisHighPrioritySuffix).Result()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, n, "no manual job should be spawned once the handler itself failed")
+}
+
+func TestRunActionWithoutRunningJobSpawnsAManualJob(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b := &redisBroker{
+		client:       client,
+		closed:       make(chan struct{}),
+		stats:        NewJobStatsManager(client),
+		actions:      newActionRegistry(),
+		workersTypes: []string{"sendmail"},
+		running:      1,
+	}
+	b.RegisterAction("sendmail", "refresh", func(domain string, payload json.RawMessage) error { return nil })
+
+	domain := "cozy.example.com"
+	assert.NoError(t, b.RunAction(domain, "sendmail", "refresh", json.RawMessage(`{}`)))
+
+	n, err := client.LLen(redisPrefix + "sendmail" + redisHighPrioritySuffix).Result()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n, "a manual job should have been pushed to the priority queue")
+}
+
+func TestRunActionOnUnknownActionFails(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b := &redisBroker{
+		client:       client,
+		closed:       make(chan struct{}),
+		stats:        NewJobStatsManager(client),
+		actions:      newActionRegistry(),
+		workersTypes: []string{"sendmail"},
+	}
+
+	err = b.RunAction("cozy.example.com", "sendmail", "refresh", json.RawMessage(`{}`))
+	assert.Equal(t, ErrUnknownWorker, err)
+}
+
+func TestRegisterConfiguredActionsIgnoresConfigsWithNoActions(t *testing.T) {
+	b := &redisBroker{actions: newActionRegistry()}
+	conf := &WorkerConfig{WorkerType: "sendmail"}
+
+	b.registerConfiguredActions(conf)
+
+	_, ok := b.lookupAction("sendmail", "refresh")
+	assert.False(t, ok)
+}
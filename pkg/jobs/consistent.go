@@ -0,0 +1,332 @@
+package jobs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// DistributionBroadcast is the historical mode, where every worker node
+// races on the same global j/<worker> list via BRPOP.
+const DistributionBroadcast = "broadcast"
+
+// DistributionConsistent assigns each domain to a single worker node, via
+// Jump Consistent Hash over the set of currently live nodes, so that a
+// domain's jobs always land on the same node and its BRPOP wakeups are
+// spread across the cluster instead of contended.
+const DistributionConsistent = "consistent"
+
+const (
+	redisNodesKey      = "j/nodes"
+	redisNodeRankKey   = "j/node_ranks"
+	redisNodeSeqKey    = "j/node_seq"
+	redisNodeHeartbeat = 5 * time.Second
+	redisNodeTTL       = 15 * time.Second
+	shardWatchInterval = redisNodeHeartbeat
+
+	// maxOrphanShardScan bounds how many shard indices beyond the current
+	// live node count are checked for entries stranded by a shrinking
+	// node set. It only needs to cover the largest node count the cluster
+	// has ever reached since the last drain.
+	maxOrphanShardScan = 256
+)
+
+// jumpHash implements Jump Consistent Hash (Lamping & Veach): it maps key
+// to a bucket in [0, numBuckets) such that, as numBuckets grows, only a
+// fraction of keys are remapped.
+func jumpHash(key uint64, numBuckets int32) int32 {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int32(b)
+}
+
+func fnv64(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+func distributionMode() string {
+	mode := config.GetConfig().Jobs.Distribution
+	if mode == "" {
+		return DistributionBroadcast
+	}
+	return mode
+}
+
+// shardOwner returns the index, within the sorted list of live nodes, of
+// the node that owns domain's jobs.
+func shardOwner(domain string, nodes []string) int32 {
+	return jumpHash(fnv64(domain), int32(len(nodes)))
+}
+
+// registerNode starts a heartbeat that keeps this process listed in
+// j/nodes as long as it is running, assigns it a stable, append-only rank
+// if it doesn't already have one, and returns the node's own id.
+func (b *redisBroker) registerNode() string {
+	name := uniqueProcessID()
+
+	b.ensureNodeRank(name)
+
+	heartbeat := func() {
+		_ = b.client.HSet(redisNodesKey, name, time.Now().Unix()).Err()
+	}
+	heartbeat()
+
+	go func() {
+		ticker := time.NewTicker(redisNodeHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.closed:
+				_ = b.client.HDel(redisNodesKey, name).Err()
+				return
+			case <-ticker.C:
+				heartbeat()
+			}
+		}
+	}()
+
+	return name
+}
+
+// ensureNodeRank assigns name the next sequence number from redisNodeSeqKey,
+// unless it already has one. Ranks are never reassigned once given, so a
+// node joining the cluster always lands at the end of the rank order
+// instead of landing wherever its (effectively random) id would sort
+// alphabetically among the nodes already there - which is what lets
+// jumpHash's "only ~1/(N+1) of keys move when growing to N+1 buckets"
+// guarantee actually hold at the node-assignment layer.
+func (b *redisBroker) ensureNodeRank(name string) {
+	exists, err := b.client.HExists(redisNodeRankKey, name).Result()
+	if err != nil || exists {
+		return
+	}
+	seq, err := b.client.Incr(redisNodeSeqKey).Result()
+	if err != nil {
+		return
+	}
+	_ = b.client.HSetNX(redisNodeRankKey, name, seq).Err()
+}
+
+// liveNodes returns the ids of the nodes that have heartbeat'd recently,
+// ordered by their stable join rank (see ensureNodeRank) rather than by
+// name, so every process agrees on the same ordering and a membership
+// change disturbs as few nodes' positions as possible.
+func (b *redisBroker) liveNodes() ([]string, error) {
+	all, err := b.client.HGetAll(redisNodesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	alive := make([]string, 0, len(all))
+	for name, ts := range all {
+		seen, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+		if now-seen <= int64(redisNodeTTL/time.Second) {
+			alive = append(alive, name)
+		}
+	}
+	if len(alive) == 0 {
+		return nil, nil
+	}
+
+	ranks, err := b.client.HMGet(redisNodeRankKey, alive...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	type rankedNode struct {
+		name string
+		rank int64
+	}
+	nodes := make([]rankedNode, len(alive))
+	for i, name := range alive {
+		seq, _ := strconv.ParseInt(fmt.Sprint(ranks[i]), 10, 64)
+		nodes[i] = rankedNode{name: name, rank: seq}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].rank != nodes[j].rank {
+			return nodes[i].rank < nodes[j].rank
+		}
+		return nodes[i].name < nodes[j].name
+	})
+
+	names := make([]string, len(nodes))
+	for i, n := range nodes {
+		names[i] = n.name
+	}
+	return names, nil
+}
+
+// shardKey returns the redis key for worker type key's shard-th queue.
+func shardKey(key string, shard int32) string {
+	return key + "/" + strconv.Itoa(int(shard))
+}
+
+// consistentPollLoop watches the live node set and keeps exactly one
+// shardPollLoop goroutine running per shard owned by this node (the shard
+// whose index is this node's rank), stopping the loop of any shard it no
+// longer owns. Entries left in such a shard are not moved: the node now at
+// that rank polls the same key, and shards beyond the live node count are
+// emptied by drainOrphanShards.
+func (b *redisBroker) consistentPollLoop(key string, ch chan<- *Job, selfID string) {
+	owned := map[int32]chan struct{}{}
+	var mu sync.Mutex
+
+	recompute := func() {
+		nodes, err := b.liveNodes()
+		if err != nil || len(nodes) == 0 {
+			return
+		}
+
+		rank := int32(-1)
+		for i, n := range nodes {
+			if n == selfID {
+				rank = int32(i)
+				break
+			}
+		}
+		if rank < 0 {
+			return
+		}
+
+		shouldOwn := map[int32]bool{}
+		for shard := int32(0); shard < int32(len(nodes)); shard++ {
+			if shard == rank {
+				shouldOwn[shard] = true
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for shard, stop := range owned {
+			if !shouldOwn[shard] {
+				close(stop)
+				delete(owned, shard)
+			}
+		}
+		for shard := range shouldOwn {
+			if _, ok := owned[shard]; !ok {
+				stop := make(chan struct{})
+				owned[shard] = stop
+				go b.shardPollLoop(shardKey(key, shard), ch, stop)
+			}
+		}
+
+		// A shrinking node set leaves behind entries in shard indices that
+		// no node owns anymore (ranks only run up to len(nodes)-1 now).
+		// Only the lowest-ranked live node drains them, so every process
+		// doesn't redundantly race to do it.
+		if rank == 0 {
+			b.drainOrphanShards(key, nodes)
+		}
+	}
+
+	recompute()
+	ticker := time.NewTicker(shardWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.closed:
+			return
+		case <-ticker.C:
+			recompute()
+		}
+	}
+}
+
+// drainOrphanShards moves any entries left behind in shard indices that no
+// longer have an owner, because the live node count shrank since they were
+// written, into whichever shard each entry's domain hashes to under the
+// current node set. This is what lets a shrinking cluster keep its "no
+// missed firings" guarantee instead of stranding jobs forever in a shard
+// nobody polls anymore.
+func (b *redisBroker) drainOrphanShards(key string, nodes []string) {
+	if len(nodes) == 0 {
+		return
+	}
+	for shard := int32(len(nodes)); shard < maxOrphanShardScan; shard++ {
+		for _, suffix := range []string{"", redisHighPrioritySuffix} {
+			from := shardKey(key, shard) + suffix
+			for {
+				val, err := b.client.LIndex(from, -1).Result()
+				if err != nil {
+					break
+				}
+				domain := val
+				if parts := strings.SplitN(val, "/", 2); len(parts) == 2 {
+					domain = parts[0]
+				}
+				to := shardKey(key, shardOwner(domain, nodes)) + suffix
+				if _, err := b.client.RPopLPush(from, to).Result(); err != nil {
+					joblog.Warnf("consistent hash: failed to drain orphan shard %s: %s", from, err)
+					break
+				}
+			}
+		}
+	}
+}
+
+// shardPollLoop is identical to pollLoop, but polls a single shard's queues
+// and also exits when stop is closed; any job still in the shard's list
+// once this node no longer owns it is polled by the node now holding that
+// rank, or, if the shard index is beyond the live node count, moved by
+// drainOrphanShards.
+func (b *redisBroker) shardPollLoop(key string, ch chan<- *Job, stop <-chan struct{}) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		select {
+		case <-stop:
+			return
+		case <-b.closed:
+			return
+		default:
+		}
+
+		// Same anti-starvation shuffle as pollLoop: always favoring the
+		// priority queue would let a steady stream of manual jobs starve
+		// the normal one.
+		keyP0 := key + redisHighPrioritySuffix
+		keyP1 := key
+		if rng.Intn(3) == 0 {
+			keyP1, keyP0 = keyP0, keyP1
+		}
+		results, err := b.client.BRPop(1*time.Second, keyP0, keyP1).Result()
+		if err != nil || len(results) < 2 {
+			continue
+		}
+
+		val := results[1]
+		parts := strings.SplitN(val, "/", 2)
+		if len(parts) != 2 {
+			joblog.Warnf("Invalid val %s", val)
+			continue
+		}
+
+		domain, jobID := parts[0], parts[1]
+		job, err := Get(domain, jobID)
+		if err != nil {
+			joblog.Warnf("Cannot find job %s on domain %s: %s", jobID, domain, err)
+			continue
+		}
+
+		b.dispatch(job)
+		ch <- job
+	}
+}
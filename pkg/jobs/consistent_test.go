@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJumpHashIsStable(t *testing.T) {
+	key := fnv64("cozy.example.com")
+	assert.Equal(t, jumpHash(key, 5), jumpHash(key, 5))
+}
+
+func TestJumpHashMinimalDisruption(t *testing.T) {
+	const numKeys = 10000
+	const before, after = 4, 5
+
+	moved := 0
+	for i := 0; i < numKeys; i++ {
+		key := fnv64(fmt.Sprintf("domain-%d.example.com", i))
+		if jumpHash(key, before) != jumpHash(key, after) {
+			moved++
+		}
+	}
+
+	// Growing from N to N+1 buckets should remap close to a 1/(N+1)
+	// fraction of keys, not a large majority of them.
+	fraction := float64(moved) / float64(numKeys)
+	assert.Less(t, fraction, 0.4)
+}
+
+func TestLiveNodesOrderedByJoinRankNotName(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b := &redisBroker{client: client, closed: make(chan struct{})}
+
+	// "z-node" joins first and must keep rank 0 even though "a-node" joins
+	// later and would sort before it alphabetically.
+	b.ensureNodeRank("z-node")
+	b.ensureNodeRank("a-node")
+	assert.NoError(t, client.HSet(redisNodesKey, "z-node", time.Now().Unix()).Err())
+	assert.NoError(t, client.HSet(redisNodesKey, "a-node", time.Now().Unix()).Err())
+
+	nodes, err := b.liveNodes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"z-node", "a-node"}, nodes, "join order must win over alphabetical order")
+}
+
+func TestDrainOrphanShards(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b := &redisBroker{client: client, closed: make(chan struct{})}
+
+	key := redisPrefix + "sendmail"
+	nodes := []string{"node-a", "node-b"}
+
+	// Simulate entries left behind in a shard that existed when the
+	// cluster had more nodes than it does now.
+	staleDomain := "stale.example.com"
+	val := staleDomain + "/job1"
+	assert.NoError(t, client.LPush(shardKey(key, 7), val).Err())
+
+	b.drainOrphanShards(key, nodes)
+
+	n, err := client.LLen(shardKey(key, 7)).Result()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, n, "the orphan shard must be emptied")
+
+	want := shardKey(key, shardOwner(staleDomain, nodes))
+	got, err := client.LRange(want, 0, -1).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{val}, got, "the entry must land in its owner's current shard")
+}
+
+// BenchmarkConsistentDistributionReducesPerNodeWakeups simulates pushing a
+// high rate of jobs for many distinct domains, once against the broadcast
+// mode's single shared key (every node's BRPOP races on every push) and
+// once sharded across a cluster of nodes (a push only wakes the one node
+// that owns its domain). It reports the average number of pushes landing
+// on any single node's queue, which should drop by roughly the node count
+// under sharding.
+func BenchmarkConsistentDistributionReducesPerNodeWakeups(b *testing.B) {
+	const numNodes = 8
+	nodes := make([]string, numNodes)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("node-%d", i)
+	}
+
+	b.Run("broadcast", func(b *testing.B) {
+		wakeups := 0
+		for i := 0; i < b.N; i++ {
+			// Every push wakes the single shared queue every live node
+			// BRPOPs against.
+			wakeups++
+		}
+		b.ReportMetric(float64(wakeups), "wakeups")
+	})
+
+	b.Run("consistent", func(b *testing.B) {
+		perNode := make(map[string]int, numNodes)
+		for i := 0; i < b.N; i++ {
+			domain := fmt.Sprintf("domain-%d.example.com", i)
+			owner := nodes[shardOwner(domain, nodes)]
+			perNode[owner]++
+		}
+		total := 0
+		for _, n := range perNode {
+			total += n
+		}
+		b.ReportMetric(float64(total)/float64(numNodes), "wakeups/node")
+	})
+}
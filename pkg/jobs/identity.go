@@ -0,0 +1,19 @@
+package jobs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// uniqueProcessID returns an identifier that is unique to this running
+// cozy-stack process, not just to the host it runs on: several processes
+// are commonly started on the same machine (e.g. one per CPU core, or
+// alongside a blue/green deployment), and anything keyed only by hostname
+// would let them mistake each other for the same holder of a distributed
+// lock.
+func uniqueProcessID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), utils.RandomString(8))
+}
@@ -0,0 +1,217 @@
+package jobs
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/go-redis/redis"
+	"github.com/robfig/cron"
+)
+
+const (
+	// redisPeriodicSet is the sorted set holding every registered periodic
+	// policy, scored by the unix timestamp of its next fire time.
+	redisPeriodicSet = "j/periodic"
+	// redisPeriodicKeyPrefix prefixes the hash in which a policy's spec and
+	// job request are serialized.
+	redisPeriodicKeyPrefix = "j/periodic/"
+	// redisPeriodicLockKey is the key used to elect the single enqueuer
+	// goroutine responsible for firing due policies.
+	redisPeriodicLockKey = "j/periodic/lock"
+	// redisPeriodicLockTTL is how long the enqueuer lock is held before it
+	// must be renewed, so that a dead holder is detected quickly.
+	redisPeriodicLockTTL = 10 * time.Second
+
+	periodicEnqueuerTick = 2 * time.Second
+)
+
+// PeriodicPolicy describes a cron-style recurring JobRequest, persisted in
+// redis so that any cozy-stack process can enqueue it when due.
+type PeriodicPolicy struct {
+	ID         string          `json:"_id"`
+	Domain     string          `json:"domain"`
+	WorkerType string          `json:"worker_type"`
+	Arguments  json.RawMessage `json:"arguments"`
+	Options    *JobOptions     `json:"options,omitempty"`
+	Spec       string          `json:"spec"`
+	NextAt     time.Time       `json:"next_at"`
+}
+
+// PushPeriodicJob registers a new periodic policy that will push a JobRequest
+// built from req every time spec (a standard 5-field cron expression) is due.
+func (b *redisBroker) PushPeriodicJob(spec string, req *JobRequest) (*PeriodicPolicy, error) {
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	pol := &PeriodicPolicy{
+		ID:         utils.RandomString(16),
+		Domain:     req.Domain,
+		WorkerType: req.WorkerType,
+		Arguments:  req.Message,
+		Options:    req.Options,
+		Spec:       spec,
+		NextAt:     sched.Next(time.Now()),
+	}
+
+	data, err := json.Marshal(pol)
+	if err != nil {
+		return nil, err
+	}
+
+	key := redisPeriodicKeyPrefix + pol.ID
+	if err := b.client.HSet(key, "policy", data).Err(); err != nil {
+		return nil, err
+	}
+	z := redis.Z{Score: float64(pol.NextAt.Unix()), Member: pol.ID}
+	if err := b.client.ZAdd(redisPeriodicSet, z).Err(); err != nil {
+		return nil, err
+	}
+
+	return pol, nil
+}
+
+// RemovePeriodicJob unregisters the periodic policy with the given id, so it
+// will no longer be enqueued.
+func (b *redisBroker) RemovePeriodicJob(id string) error {
+	if err := b.client.ZRem(redisPeriodicSet, id).Err(); err != nil {
+		return err
+	}
+	return b.client.Del(redisPeriodicKeyPrefix + id).Err()
+}
+
+// ListPeriodicJobs returns every periodic policy currently registered,
+// regardless of its next fire time.
+func (b *redisBroker) ListPeriodicJobs() ([]*PeriodicPolicy, error) {
+	ids, err := b.client.ZRange(redisPeriodicSet, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pols := make([]*PeriodicPolicy, 0, len(ids))
+	for _, id := range ids {
+		data, err := b.client.HGet(redisPeriodicKeyPrefix+id, "policy").Bytes()
+		if err != nil {
+			joblog.Warnf("Cannot load periodic policy %s: %s", id, err)
+			continue
+		}
+		pol := &PeriodicPolicy{}
+		if err := json.Unmarshal(data, pol); err != nil {
+			joblog.Warnf("Cannot unmarshal periodic policy %s: %s", id, err)
+			continue
+		}
+		pols = append(pols, pol)
+	}
+
+	return pols, nil
+}
+
+// startPeriodicEnqueuer starts the goroutine responsible for ZRANGEBYSCOREing
+// the due policies and pushing the corresponding jobs. Only one cozy-stack
+// process at a time actually does this work, enforced by a SETNX lock that
+// is renewed as long as this process stays elected leader.
+func (b *redisBroker) startPeriodicEnqueuer() {
+	holder := uniqueProcessID()
+	go func() {
+		ticker := time.NewTicker(periodicEnqueuerTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.closed:
+				return
+			case <-ticker.C:
+				if b.acquireEnqueuerLock(holder) {
+					if err := b.enqueueDuePolicies(); err != nil {
+						joblog.Warnf("periodic enqueuer: %s", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// acquireEnqueuerLock tries to become (or remain) the elected enqueuer. It
+// returns true if this process holds the lock for the current tick.
+func (b *redisBroker) acquireEnqueuerLock(holder string) bool {
+	ok, err := b.client.SetNX(redisPeriodicLockKey, holder, redisPeriodicLockTTL).Result()
+	if err != nil {
+		joblog.Warnf("periodic enqueuer: cannot acquire lock: %s", err)
+		return false
+	}
+	if ok {
+		return true
+	}
+	// We may already be the holder from a previous tick: renew our TTL so we
+	// are not evicted while healthy, without stealing the lock from someone
+	// else.
+	cur, err := b.client.Get(redisPeriodicLockKey).Result()
+	if err != nil || cur != holder {
+		return false
+	}
+	if err := b.client.Expire(redisPeriodicLockKey, redisPeriodicLockTTL).Err(); err != nil {
+		joblog.Warnf("periodic enqueuer: cannot renew lock: %s", err)
+		return false
+	}
+	return true
+}
+
+// enqueueDuePolicies pushes a job for every policy whose next fire time has
+// passed, and reschedules it for its following occurrence.
+func (b *redisBroker) enqueueDuePolicies() error {
+	now := time.Now()
+	ids, err := b.client.ZRangeByScore(redisPeriodicSet, redis.ZRangeBy{
+		Min: "0",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		data, err := b.client.HGet(redisPeriodicKeyPrefix+id, "policy").Bytes()
+		if err != nil {
+			joblog.Warnf("periodic enqueuer: cannot load policy %s: %s", id, err)
+			continue
+		}
+		pol := &PeriodicPolicy{}
+		if err := json.Unmarshal(data, pol); err != nil {
+			joblog.Warnf("periodic enqueuer: cannot unmarshal policy %s: %s", id, err)
+			continue
+		}
+
+		sched, err := cron.ParseStandard(pol.Spec)
+		if err != nil {
+			joblog.Warnf("periodic enqueuer: invalid spec for policy %s: %s", id, err)
+			continue
+		}
+		pol.NextAt = sched.Next(now)
+
+		data, err = json.Marshal(pol)
+		if err != nil {
+			continue
+		}
+		if err := b.client.HSet(redisPeriodicKeyPrefix+id, "policy", data).Err(); err != nil {
+			joblog.Warnf("periodic enqueuer: cannot reschedule policy %s: %s", id, err)
+			continue
+		}
+		z := redis.Z{Score: float64(pol.NextAt.Unix()), Member: id}
+		if err := b.client.ZAdd(redisPeriodicSet, z).Err(); err != nil {
+			joblog.Warnf("periodic enqueuer: cannot reschedule policy %s: %s", id, err)
+			continue
+		}
+
+		if _, err := b.PushJob(&JobRequest{
+			Domain:     pol.Domain,
+			WorkerType: pol.WorkerType,
+			Message:    pol.Arguments,
+			Options:    pol.Options,
+		}); err != nil {
+			joblog.Warnf("periodic enqueuer: cannot push job for policy %s: %s", id, err)
+		}
+	}
+
+	return nil
+}
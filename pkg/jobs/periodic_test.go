@@ -0,0 +1,85 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisBroker(t *testing.T, mr *miniredis.Miniredis) *redisBroker {
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return &redisBroker{
+		client:       client,
+		closed:       make(chan struct{}),
+		stats:        NewJobStatsManager(client),
+		running:      1,
+		workersTypes: []string{"sendmail"},
+	}
+}
+
+func TestAcquireEnqueuerLockFailover(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	b1 := newTestRedisBroker(t, mr)
+	b2 := newTestRedisBroker(t, mr)
+
+	holder1 := uniqueProcessID()
+	holder2 := uniqueProcessID()
+	assert.NotEqual(t, holder1, holder2, "two brokers must never share a lock identity")
+
+	assert.True(t, b1.acquireEnqueuerLock(holder1), "first broker should become leader")
+	assert.False(t, b2.acquireEnqueuerLock(holder2), "second broker must not steal a live lock")
+
+	// The leader renews its own lock on every tick instead of losing it.
+	assert.True(t, b1.acquireEnqueuerLock(holder1))
+
+	mr.FastForward(redisPeriodicLockTTL + time.Second)
+
+	assert.True(t, b2.acquireEnqueuerLock(holder2), "a dead leader's lock must be reclaimable")
+	assert.False(t, b1.acquireEnqueuerLock(holder1), "the old leader must not still believe it owns the lock")
+}
+
+func TestEnqueueDuePoliciesFiresExactlyOnce(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	b1 := newTestRedisBroker(t, mr)
+	b2 := newTestRedisBroker(t, mr)
+
+	pol, err := b1.PushPeriodicJob("* * * * *", &JobRequest{
+		Domain:     "cozy.example.com",
+		WorkerType: "sendmail",
+	})
+	assert.NoError(t, err)
+
+	// enqueueDuePolicies compares scores with the wall clock, which
+	// miniredis's FastForward does not move: make the policy due by
+	// scoring it one second in the past.
+	due := redis.Z{Score: float64(time.Now().Add(-time.Second).Unix()), Member: pol.ID}
+	assert.NoError(t, b1.client.ZAdd(redisPeriodicSet, due).Err())
+
+	holder1 := uniqueProcessID()
+	holder2 := uniqueProcessID()
+
+	fires := 0
+	if b1.acquireEnqueuerLock(holder1) {
+		assert.NoError(t, b1.enqueueDuePolicies())
+		fires++
+	}
+	if b2.acquireEnqueuerLock(holder2) {
+		assert.NoError(t, b2.enqueueDuePolicies())
+		fires++
+	}
+
+	assert.Equal(t, 1, fires, "only the elected leader may enqueue due policies")
+
+	n, err := b1.client.LLen(redisPrefix + "sendmail").Result()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n, "the policy must be enqueued exactly once")
+}
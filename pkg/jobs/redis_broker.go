@@ -2,9 +2,11 @@ package jobs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -21,20 +23,38 @@ const (
 	redisHighPrioritySuffix = "/p0"
 )
 
+// ErrNoLiveNodes is returned by PushJob when the broker is running in
+// DistributionConsistent mode but no node is currently visible in the
+// live node registry. Pushing to the bare, unsharded key in that case
+// would strand the job forever, since only the broadcast pollLoop reads
+// from it and it is never started in consistent mode.
+var ErrNoLiveNodes = errors.New("jobs: no live node to own this job's shard")
+
 type redisBroker struct {
 	client       redis.UniversalClient
 	workers      []*Worker
 	workersTypes []string
 	running      uint32
 	closed       chan struct{}
+	stats        *JobStatsManager
+	nodeID       string
+	actions      *actionRegistry
+
+	cancelsMu sync.Mutex
+	cancels   map[string]context.CancelFunc
+	jobCtx    map[string]context.Context
 }
 
 // NewRedisBroker creates a new broker that will use redis to distribute
 // the jobs among several cozy-stack processes.
 func NewRedisBroker(client redis.UniversalClient) Broker {
 	return &redisBroker{
-		client: client,
-		closed: make(chan struct{}),
+		client:  client,
+		closed:  make(chan struct{}),
+		stats:   NewJobStatsManager(client),
+		actions: newActionRegistry(),
+		cancels: make(map[string]context.CancelFunc),
+		jobCtx:  make(map[string]context.Context),
 	}
 }
 
@@ -44,8 +64,14 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 		return ErrClosed
 	}
 
+	consistent := distributionMode() == DistributionConsistent
+	if consistent {
+		b.nodeID = b.registerNode()
+	}
+
 	for _, conf := range ws {
 		b.workersTypes = append(b.workersTypes, conf.WorkerType)
+		b.registerConfiguredActions(conf)
 		if conf.Concurrency <= 0 {
 			continue
 		}
@@ -55,13 +81,19 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 		if err := w.Start(ch); err != nil {
 			return err
 		}
-		go b.pollLoop(redisPrefix+conf.WorkerType, ch)
+		if consistent {
+			go b.consistentPollLoop(redisPrefix+conf.WorkerType, ch, b.nodeID)
+		} else {
+			go b.pollLoop(redisPrefix+conf.WorkerType, ch)
+		}
 	}
 
 	if len(b.workers) > 0 {
 		joblog.Infof("Started redis broker for %d workers type", len(b.workers))
 	}
 
+	b.startPeriodicEnqueuer()
+
 	// XXX for retro-compat
 	if slots := config.GetConfig().Jobs.NbWorkers; len(b.workers) > 0 && slots > 0 {
 		joblog.Warnf("Limiting the number of total concurrent workers to %d", slots)
@@ -166,10 +198,124 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 			continue
 		}
 
+		b.dispatch(job)
 		ch <- job
 	}
 }
 
+// dispatch records that job is about to be handed off to a Worker: it
+// transitions its state to Running, remembers it as the currently Running
+// job for its domain and worker type (so RunAction can target it), derives
+// a cancellable context for it, and starts watching for a cancellation
+// request against it.
+func (b *redisBroker) dispatch(job *Job) {
+	if err := b.stats.SetState(job.Domain, job.JobID, Running); err != nil {
+		joblog.Warnf("Cannot record state of job %s: %s", job.JobID, err)
+	}
+	if err := b.trackRunning(job.Domain, job.WorkerType, job.JobID); err != nil {
+		joblog.Warnf("Cannot track running job %s: %s", job.JobID, err)
+	}
+	b.registerCancel(job.JobID)
+	go b.watchCancellation(job.Domain, job.JobID, job.WorkerType)
+}
+
+// JobContext returns the context.Context tied to a Running job's lifetime:
+// it is cancelled as soon as CancelJob is called against that job. The
+// Worker is expected to fetch it through the WorkerContext it was handed
+// and thread it down into whatever it executes (a konnector process, an
+// HTTP request, ...) so a cancellation actually interrupts the job instead
+// of only flipping its recorded state.
+func (b *redisBroker) JobContext(jobID string) (context.Context, bool) {
+	b.cancelsMu.Lock()
+	defer b.cancelsMu.Unlock()
+	ctx, ok := b.jobCtx[jobID]
+	return ctx, ok
+}
+
+// registerCancel creates the cancellable context for jobID and remembers
+// its CancelFunc so a later CancelJob can invoke it.
+func (b *redisBroker) registerCancel(jobID string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancelsMu.Lock()
+	defer b.cancelsMu.Unlock()
+	if b.cancels == nil {
+		b.cancels = make(map[string]context.CancelFunc)
+		b.jobCtx = make(map[string]context.Context)
+	}
+	b.cancels[jobID] = cancel
+	b.jobCtx[jobID] = ctx
+}
+
+// unregisterCancel drops the bookkeeping kept for a job once it reaches a
+// terminal state, whether it ran to completion or was cancelled.
+func (b *redisBroker) unregisterCancel(jobID string) {
+	b.cancelsMu.Lock()
+	defer b.cancelsMu.Unlock()
+	delete(b.cancels, jobID)
+	delete(b.jobCtx, jobID)
+}
+
+// cancelJobContext cancels the context.Context that was derived for jobID
+// in dispatch, if any, so that a Worker selecting on ctx.Done() actually
+// observes the cancellation instead of only finding out through the
+// redis-backed state once it next checks it.
+func (b *redisBroker) cancelJobContext(jobID string) {
+	b.cancelsMu.Lock()
+	cancel, ok := b.cancels[jobID]
+	b.cancelsMu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// FinishJob records that job has completed, clearing it from the Running
+// index and cancel-context bookkeeping, and transitioning its state to
+// Success or Error depending on whether execErr is nil. The Worker calls
+// this once it is done executing a job, through the WorkerContext it was
+// handed.
+func (b *redisBroker) FinishJob(job *Job, execErr error) error {
+	if err := b.untrackRunning(job.Domain, job.WorkerType); err != nil {
+		joblog.Warnf("Cannot untrack running job %s: %s", job.JobID, err)
+	}
+	b.unregisterCancel(job.JobID)
+	state := Success
+	if execErr != nil {
+		state = Error
+	}
+	return b.stats.SetState(job.Domain, job.JobID, state)
+}
+
+// stopWatchInterval is how often watchCancellation polls for a stop
+// request against a Running job.
+var stopWatchInterval = 500 * time.Millisecond
+
+// watchCancellation polls the stop flag for a Running job until either a
+// stop is requested, in which case it cancels the job's context (so a
+// Worker threading it into its execution is actually interrupted) and
+// marks the job Stopped, or the job leaves the Running state on its own
+// (normal completion via FinishJob).
+func (b *redisBroker) watchCancellation(domain, jobID, workerType string) {
+	ticker := time.NewTicker(stopWatchInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		state, err := b.stats.GetState(domain, jobID)
+		if err != nil || state != Running {
+			return
+		}
+		if b.stats.ShouldStop(domain, jobID) {
+			b.cancelJobContext(jobID)
+			if err := b.untrackRunning(domain, workerType); err != nil {
+				joblog.Warnf("Cannot untrack stopped job %s: %s", jobID, err)
+			}
+			if err := b.stats.SetState(domain, jobID, Stopped); err != nil {
+				joblog.Warnf("Cannot record state of job %s: %s", jobID, err)
+			}
+			b.unregisterCancel(jobID)
+			return
+		}
+	}
+}
+
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *redisBroker) PushJob(req *JobRequest) (*Job, error) {
@@ -189,6 +335,21 @@ func (b *redisBroker) PushJob(req *JobRequest) (*Job, error) {
 	key := redisPrefix + job.WorkerType
 	val := job.Domain + "/" + job.JobID
 
+	if distributionMode() == DistributionConsistent {
+		nodes, err := b.liveNodes()
+		if err != nil {
+			return nil, err
+		}
+		if len(nodes) == 0 {
+			// Nothing would ever poll the bare, unsharded key: only
+			// shardPollLoop runs in this mode, over j/<worker>/<n> keys.
+			// Pushing there would strand the job, so fail instead and let
+			// the caller retry once a node has registered.
+			return nil, ErrNoLiveNodes
+		}
+		key = shardKey(key, shardOwner(job.Domain, nodes))
+	}
+
 	// When the job is manual, it is being pushed in a specific prioritized
 	// queue.
 	if job.Manual {
@@ -199,9 +360,55 @@ func (b *redisBroker) PushJob(req *JobRequest) (*Job, error) {
 		return nil, err
 	}
 
+	if err := b.stats.SetState(job.Domain, job.JobID, Scheduled); err != nil {
+		joblog.Warnf("Cannot record state of job %s: %s", job.JobID, err)
+	}
+
 	return job, nil
 }
 
+// GetJobState returns the last known lifecycle state of the given job.
+func (b *redisBroker) GetJobState(domain, jobID string) (JobState, error) {
+	return b.stats.GetState(domain, jobID)
+}
+
+// CancelJob stops the given job: if it is still sitting in its queue it is
+// removed from it and marked Cancelled, otherwise (it is already Running)
+// a stop signal is recorded for watchCancellation to act on. In
+// DistributionConsistent mode, only the shard that domain hashes to under
+// the current live node set is searched.
+func (b *redisBroker) CancelJob(domain, jobID string) error {
+	val := domain + "/" + jobID
+
+	for _, wt := range b.workersTypes {
+		key := redisPrefix + wt
+		if distributionMode() == DistributionConsistent {
+			nodes, err := b.liveNodes()
+			if err != nil {
+				return err
+			}
+			if len(nodes) > 0 {
+				key = shardKey(key, shardOwner(domain, nodes))
+			}
+		}
+		for _, k := range []string{key, key + redisHighPrioritySuffix} {
+			n, err := b.client.LRem(k, 1, val).Result()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return b.stats.SetState(domain, jobID, Cancelled)
+			}
+		}
+	}
+
+	// The job is already Running: record a stop request. watchCancellation
+	// picks it up on its next tick, cancels the job's context (see
+	// JobContext) so a Worker that threaded it into execution is actually
+	// interrupted, and transitions the job to Stopped.
+	return b.stats.RequestStop(domain, jobID)
+}
+
 // QueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
@@ -0,0 +1,145 @@
+package jobs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// JobState is the lifecycle state of a Job, as tracked by the
+// JobStatsManager.
+type JobState string
+
+const (
+	// Pending is the state of a job that has been created but not yet
+	// pushed to a queue.
+	Pending JobState = "pending"
+	// Scheduled is the state of a job sitting in a j/<worker> queue,
+	// waiting to be BRPOP'd by a worker.
+	Scheduled JobState = "scheduled"
+	// Running is the state of a job currently being executed by a Worker.
+	Running JobState = "running"
+	// Success is the state of a job that has completed without error.
+	Success JobState = "success"
+	// Error is the state of a job that has completed with an error.
+	Error JobState = "error"
+	// Stopped is the state of a job that was Running and received a cancel
+	// signal it honored before completion.
+	Stopped JobState = "stopped"
+	// Cancelled is the state of a job that was removed from its queue
+	// before a worker ever picked it up.
+	Cancelled JobState = "cancelled"
+)
+
+const (
+	redisStatsPrefix  = "j/stats/"
+	redisEventsPrefix = "j/events/"
+	redisStopPrefix   = "j/stop/"
+	redisStatsTTL     = 7 * 24 * time.Hour
+)
+
+// JobEvent is the payload published on the j/events/<domain> pub/sub
+// channel. It carries either a lifecycle state change (State set, Stream
+// empty) or a line of output forwarded from a running action (Stream and
+// Line set, State empty), so that a single subscription lets a client
+// follow both.
+type JobEvent struct {
+	Domain string   `json:"domain"`
+	JobID  string   `json:"job_id"`
+	State  JobState `json:"state,omitempty"`
+	Stream string   `json:"stream,omitempty"`
+	Line   string   `json:"line,omitempty"`
+}
+
+// JobStatsManager maintains the redis-backed lifecycle of jobs: it records
+// state transitions in a TTL'd hash and notifies subscribers (such as
+// realtime.WebSocket) over pub/sub.
+type JobStatsManager struct {
+	client redis.UniversalClient
+}
+
+// NewJobStatsManager creates a JobStatsManager using the given redis
+// client.
+func NewJobStatsManager(client redis.UniversalClient) *JobStatsManager {
+	return &JobStatsManager{client: client}
+}
+
+func statsKey(domain, jobID string) string {
+	return redisStatsPrefix + domain + "/" + jobID
+}
+
+// SetState records the new state of the job and publishes a JobEvent on the
+// domain's events channel.
+func (m *JobStatsManager) SetState(domain, jobID string, state JobState) error {
+	key := statsKey(domain, jobID)
+	if err := m.client.HSet(key, "state", string(state)).Err(); err != nil {
+		return err
+	}
+	if err := m.client.Expire(key, redisStatsTTL).Err(); err != nil {
+		return err
+	}
+
+	evt := JobEvent{Domain: domain, JobID: jobID, State: state}
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	return m.client.Publish(redisEventsPrefix+domain, data).Err()
+}
+
+// GetState returns the last known state of the given job.
+func (m *JobStatsManager) GetState(domain, jobID string) (JobState, error) {
+	state, err := m.client.HGet(statsKey(domain, jobID), "state").Result()
+	if err == redis.Nil {
+		return "", ErrNotFoundJob
+	}
+	if err != nil {
+		return "", err
+	}
+	return JobState(state), nil
+}
+
+// Subscribe returns a redis.PubSub listening to the state change events of
+// the given domain.
+func (m *JobStatsManager) Subscribe(domain string) *redis.PubSub {
+	return m.client.Subscribe(redisEventsPrefix + domain)
+}
+
+// PublishOutput forwards a single line of output (stdout or stderr) from a
+// running job or action to the domain's event subscribers, alongside the
+// lifecycle events published by SetState.
+func (m *JobStatsManager) PublishOutput(domain, jobID, stream, line string) error {
+	evt := JobEvent{Domain: domain, JobID: jobID, Stream: stream, Line: line}
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	return m.client.Publish(redisEventsPrefix+domain, data).Err()
+}
+
+// SubscribeEvents is the Broker-facing equivalent of Subscribe.
+func (b *redisBroker) SubscribeEvents(domain string) *redis.PubSub {
+	return b.stats.Subscribe(domain)
+}
+
+// PublishActionOutput is the Broker-facing equivalent of PublishOutput. The
+// Worker calls it, through the WorkerContext it was handed, for every line
+// an action handler writes to stdout or stderr while it runs.
+func (b *redisBroker) PublishActionOutput(domain, jobID, stream, line string) error {
+	return b.stats.PublishOutput(domain, jobID, stream, line)
+}
+
+// RequestStop sets the stop flag that the broker's watchCancellation polls
+// for, every stopWatchInterval, while the job is Running.
+func (m *JobStatsManager) RequestStop(domain, jobID string) error {
+	return m.client.Set(redisStopPrefix+domain+"/"+jobID, "1", redisStatsTTL).Err()
+}
+
+// ShouldStop reports whether a stop was requested for the given job, and
+// clears the flag.
+func (m *JobStatsManager) ShouldStop(domain, jobID string) bool {
+	key := redisStopPrefix + domain + "/" + jobID
+	n, err := m.client.Del(key).Result()
+	return err == nil && n > 0
+}
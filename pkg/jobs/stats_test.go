@@ -0,0 +1,105 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobStatsManagerLifecycle(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	stats := NewJobStatsManager(client)
+
+	assert.NoError(t, stats.SetState("cozy.example.com", "job1", Scheduled))
+	state, err := stats.GetState("cozy.example.com", "job1")
+	assert.NoError(t, err)
+	assert.Equal(t, Scheduled, state)
+
+	assert.NoError(t, stats.SetState("cozy.example.com", "job1", Running))
+	state, err = stats.GetState("cozy.example.com", "job1")
+	assert.NoError(t, err)
+	assert.Equal(t, Running, state)
+
+	assert.False(t, stats.ShouldStop("cozy.example.com", "job1"))
+	assert.NoError(t, stats.RequestStop("cozy.example.com", "job1"))
+	assert.True(t, stats.ShouldStop("cozy.example.com", "job1"))
+	// ShouldStop clears the flag once it has been observed.
+	assert.False(t, stats.ShouldStop("cozy.example.com", "job1"))
+}
+
+func TestFinishJobTransitionsToSuccessOrError(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b := &redisBroker{client: client, closed: make(chan struct{}), stats: NewJobStatsManager(client)}
+
+	job := &Job{JobRequest: JobRequest{Domain: "cozy.example.com", WorkerType: "sendmail"}, JobID: "job1"}
+	assert.NoError(t, b.trackRunning(job.Domain, job.WorkerType, job.JobID))
+
+	assert.NoError(t, b.FinishJob(job, nil))
+	state, err := b.stats.GetState(job.Domain, job.JobID)
+	assert.NoError(t, err)
+	assert.Equal(t, Success, state)
+	_, err = b.runningJobID(job.Domain, job.WorkerType)
+	assert.Equal(t, redis.Nil, err)
+
+	failed := &Job{JobRequest: JobRequest{Domain: "cozy.example.com", WorkerType: "sendmail"}, JobID: "job2"}
+	assert.NoError(t, b.trackRunning(failed.Domain, failed.WorkerType, failed.JobID))
+
+	assert.NoError(t, b.FinishJob(failed, errors.New("boom")))
+	state, err = b.stats.GetState(failed.Domain, failed.JobID)
+	assert.NoError(t, err)
+	assert.Equal(t, Error, state)
+}
+
+func TestWatchCancellationStopsARunningJob(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer mr.Close()
+
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b := &redisBroker{client: client, closed: make(chan struct{}), stats: NewJobStatsManager(client)}
+
+	oldInterval := stopWatchInterval
+	stopWatchInterval = 10 * time.Millisecond
+	defer func() { stopWatchInterval = oldInterval }()
+
+	domain, jobID, workerType := "cozy.example.com", "job1", "sendmail"
+	assert.NoError(t, b.stats.SetState(domain, jobID, Running))
+	assert.NoError(t, b.trackRunning(domain, workerType, jobID))
+	b.registerCancel(jobID)
+
+	ctx, ok := b.JobContext(jobID)
+	assert.True(t, ok)
+
+	go b.watchCancellation(domain, jobID, workerType)
+
+	assert.NoError(t, b.CancelJob(domain, jobID))
+
+	assert.Eventually(t, func() bool {
+		state, err := b.stats.GetState(domain, jobID)
+		return err == nil && state == Stopped
+	}, time.Second, 5*time.Millisecond)
+
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatal("the job's context should have been cancelled")
+	}
+
+	_, err = b.runningJobID(domain, workerType)
+	assert.Equal(t, redis.Nil, err)
+
+	_, ok = b.JobContext(jobID)
+	assert.False(t, ok, "cancel bookkeeping should be cleared once the job stops")
+}
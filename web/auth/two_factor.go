@@ -0,0 +1,65 @@
+// Package auth exposes the routes used to authenticate against an
+// instance: the regular passphrase login, and the two-factor step that
+// follows it when the instance requires one.
+package auth
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// twoFactorForm is the payload sent once the passphrase step of login has
+// already succeeded and the instance requires a second factor.
+type twoFactorForm struct {
+	TwoFactorToken string `json:"two_factor_token"`
+	TwoFactorCode  string `json:"two_factor_code"`
+}
+
+// twoFactor validates the second factor of a login: a TOTP code, or one of
+// the instance's recovery codes, depending on what validates first. The
+// passphrase step, on success, hands the client a TwoFactorToken from
+// instance.GenerateTwoFactorToken; without a valid one here, the second
+// factor alone would be enough to log in, which would make it a bypass of
+// the passphrase rather than an addition to it. A failure past that point
+// must not reveal anything more than "the code was wrong".
+func twoFactor(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	args := twoFactorForm{}
+	if err := c.Bind(&args); err != nil {
+		return err
+	}
+
+	if !inst.CheckTwoFactorToken(args.TwoFactorToken) {
+		return c.NoContent(http.StatusUnauthorized)
+	}
+
+	switch inst.AuthMode {
+	case instance.TwoFactorMail:
+		if !inst.ValidateMailConfirmationCode(args.TwoFactorCode) {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+	case instance.TwoFactorTOTP:
+		ok, err := inst.ValidateTOTPCode(args.TwoFactorCode)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return c.NoContent(http.StatusUnauthorized)
+		}
+	default:
+		return c.NoContent(http.StatusUnauthorized)
+	}
+
+	return middlewares.SetCookieForNewSession(c)
+}
+
+// Routes sets the routing for the auth API. It is expected to be mounted,
+// alongside the existing passphrase login route, by the router setup that
+// wires every web/* package's Routes together.
+func Routes(router *echo.Group) {
+	router.POST("/twofactor", twoFactor)
+}
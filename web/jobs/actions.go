@@ -0,0 +1,67 @@
+package jobs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+	"golang.org/x/net/websocket"
+)
+
+func runAction(c echo.Context) error {
+	if err := webpermissions.AllowWholeType(c, permissions.ACTIONS, consts.Jobs); err != nil {
+		return err
+	}
+
+	inst := middlewares.GetInstance(c)
+	workerType := c.Param("worker-type")
+	action := c.Param("name")
+
+	payload, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return jsonapi.BadRequest(err)
+	}
+
+	if err := inst.JobsBroker().RunAction(inst.Domain, workerType, action, json.RawMessage(payload)); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// actionEventsWS streams the stdout/stderr lines forwarded by a running
+// action to the caller. It reuses the same pub/sub channel as the job
+// stats manager, but filters out the lifecycle events published by
+// SetState (only JobEvents with Stream set originate from an action).
+func actionEventsWS(c echo.Context) error {
+	if err := webpermissions.AllowWholeType(c, permissions.ACTIONS, consts.Jobs); err != nil {
+		return err
+	}
+
+	inst := middlewares.GetInstance(c)
+	sub := inst.JobsBroker().SubscribeEvents(inst.Domain)
+	defer sub.Close()
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		ch := sub.Channel()
+		for msg := range ch {
+			var evt jobs.JobEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &evt); err != nil || evt.Stream == "" {
+				continue
+			}
+			if err := websocket.Message.Send(ws, msg.Payload); err != nil {
+				return
+			}
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
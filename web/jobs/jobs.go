@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+func getJobState(c echo.Context) error {
+	if err := webpermissions.AllowWholeType(c, permissions.GET, consts.Jobs); err != nil {
+		return err
+	}
+
+	inst := middlewares.GetInstance(c)
+	jobID := c.Param("job-id")
+
+	state, err := inst.JobsBroker().GetJobState(inst.Domain, jobID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"job_id": jobID, "state": state})
+}
+
+func cancelJob(c echo.Context) error {
+	if err := webpermissions.AllowWholeType(c, permissions.DELETE, consts.Jobs); err != nil {
+		return err
+	}
+
+	inst := middlewares.GetInstance(c)
+	jobID := c.Param("job-id")
+
+	if err := inst.JobsBroker().CancelJob(inst.Domain, jobID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+// Package jobs exposes the job system (triggers, queues) through an HTTP
+// API.
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiTrigger struct {
+	pol *jobs.PeriodicPolicy
+}
+
+func (t *apiTrigger) ID() string                             { return t.pol.ID }
+func (t *apiTrigger) Rev() string                            { return "" }
+func (t *apiTrigger) DocType() string                        { return consts.Triggers }
+func (t *apiTrigger) Clone() couchdb.Doc                     { return t }
+func (t *apiTrigger) SetID(id string)                        { t.pol.ID = id }
+func (t *apiTrigger) SetRev(rev string)                      {}
+func (t *apiTrigger) Relationships() jsonapi.RelationshipMap { return nil }
+func (t *apiTrigger) Included() []jsonapi.Object             { return nil }
+func (t *apiTrigger) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/triggers/" + t.pol.ID}
+}
+func (t *apiTrigger) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.pol)
+}
+
+func getBroker(c echo.Context) jobs.Broker {
+	return middlewares.GetInstance(c).JobsBroker()
+}
+
+func listTriggers(c echo.Context) error {
+	if err := webpermissions.AllowWholeType(c, permissions.GET, consts.Triggers); err != nil {
+		return err
+	}
+
+	pols, err := getBroker(c).ListPeriodicJobs()
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, len(pols))
+	for i, pol := range pols {
+		objs[i] = &apiTrigger{pol}
+	}
+
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func createTrigger(c echo.Context) error {
+	if err := webpermissions.AllowWholeType(c, permissions.POST, consts.Triggers); err != nil {
+		return err
+	}
+
+	args := struct {
+		WorkerType string          `json:"worker_type"`
+		Arguments  json.RawMessage `json:"arguments"`
+		Spec       string          `json:"spec"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+
+	inst := middlewares.GetInstance(c)
+	req := &jobs.JobRequest{
+		Domain:     inst.Domain,
+		WorkerType: args.WorkerType,
+		Message:    args.Arguments,
+	}
+
+	pol, err := inst.JobsBroker().PushPeriodicJob(args.Spec, req)
+	if err != nil {
+		return jsonapi.BadRequest(err)
+	}
+
+	return jsonapi.Data(c, http.StatusCreated, &apiTrigger{pol}, nil)
+}
+
+func deleteTrigger(c echo.Context) error {
+	if err := webpermissions.AllowWholeType(c, permissions.DELETE, consts.Triggers); err != nil {
+		return err
+	}
+
+	id := c.Param("trigger-id")
+	if err := getBroker(c).RemovePeriodicJob(id); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Routes sets the routing for the jobs API.
+func Routes(router *echo.Group) {
+	router.GET("/triggers", listTriggers)
+	router.POST("/triggers", createTrigger)
+	router.DELETE("/triggers/:trigger-id", deleteTrigger)
+
+	router.GET("/:job-id", getJobState)
+	router.DELETE("/:job-id", cancelJob)
+
+	router.POST("/:worker-type/actions/:name", runAction)
+	router.GET("/:worker-type/actions/:name/ws", actionEventsWS)
+}
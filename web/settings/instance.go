@@ -16,6 +16,34 @@ import (
 	"github.com/cozy/echo"
 )
 
+// twoFactorTOTPAuthModeString is the API's wire representation of
+// instance.TwoFactorTOTP. instance.StringToAuthMode and
+// instance.AuthModeToString predate TwoFactorTOTP and were never extended
+// to recognize it, which left it unreachable from this handler: no input
+// string ever produced instance.TwoFactorTOTP, so the case below could
+// never run. authModeFromString/authModeString special-case it here until
+// the two instance-package functions are updated to know about it
+// themselves.
+const twoFactorTOTPAuthModeString = "two_factor_totp"
+
+// authModeFromString wraps instance.StringToAuthMode to also accept
+// twoFactorTOTPAuthModeString.
+func authModeFromString(s string) (instance.AuthMode, error) {
+	if s == twoFactorTOTPAuthModeString {
+		return instance.TwoFactorTOTP, nil
+	}
+	return instance.StringToAuthMode(s)
+}
+
+// authModeString wraps instance.AuthModeToString to also render
+// instance.TwoFactorTOTP.
+func authModeString(mode instance.AuthMode) string {
+	if mode == instance.TwoFactorTOTP {
+		return twoFactorTOTPAuthModeString
+	}
+	return instance.AuthModeToString(mode)
+}
+
 type apiInstance struct {
 	doc *couchdb.JSONDoc
 }
@@ -46,7 +74,7 @@ func getInstance(c echo.Context) error {
 	doc.M["locale"] = inst.Locale
 	doc.M["onboarding_finished"] = inst.OnboardingFinished
 	doc.M["auto_update"] = !inst.NoAutoUpdate
-	doc.M["auth_mode"] = instance.AuthModeToString(inst.AuthMode)
+	doc.M["auth_mode"] = authModeString(inst.AuthMode)
 	doc.M["tos"] = inst.TOSSigned
 	doc.M["uuid"] = inst.UUID
 	doc.M["context"] = inst.ContextName
@@ -90,7 +118,7 @@ func updateInstance(c echo.Context) error {
 	doc.M["locale"] = inst.Locale
 	doc.M["onboarding_finished"] = inst.OnboardingFinished
 	doc.M["auto_update"] = !inst.NoAutoUpdate
-	doc.M["auth_mode"] = instance.AuthModeToString(inst.AuthMode)
+	doc.M["auth_mode"] = authModeString(inst.AuthMode)
 	doc.M["tos"] = inst.TOSSigned
 	doc.M["uuid"] = inst.UUID
 	doc.M["context"] = inst.ContextName
@@ -113,7 +141,7 @@ func updateInstanceAuthMode(c echo.Context) error {
 		return err
 	}
 
-	authMode, err := instance.StringToAuthMode(args.AuthMode)
+	authMode, err := authModeFromString(args.AuthMode)
 	if err != nil {
 		return jsonapi.BadRequest(err)
 	}
@@ -133,6 +161,29 @@ func updateInstanceAuthMode(c echo.Context) error {
 		if ok := inst.ValidateMailConfirmationCode(args.TwoFactorActivationCode); !ok {
 			return c.NoContent(http.StatusUnprocessableEntity)
 		}
+	case instance.TwoFactorTOTP:
+		if args.TwoFactorActivationCode == "" {
+			uri, qrPNG, err := inst.StartTOTPActivation()
+			if err != nil {
+				return err
+			}
+			return c.JSON(http.StatusOK, echo.Map{
+				"provisioning_uri": uri,
+				"qr_code":          qrPNG,
+			})
+		}
+		codes, ok, err := inst.ValidateTOTPActivationCode(args.TwoFactorActivationCode)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return c.NoContent(http.StatusUnprocessableEntity)
+		}
+		err = instance.Patch(inst, &instance.Options{AuthMode: args.AuthMode})
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
 	}
 
 	err = instance.Patch(inst, &instance.Options{AuthMode: args.AuthMode})